@@ -0,0 +1,210 @@
+package shell
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/process"
+	"github.com/pkg/errors"
+)
+
+// Command is a builder for a single command to be run in the context of a
+// Shell, chained method-by-method the way an os/exec.Cmd is assembled: set
+// whatever of Stdin, Stdout, Stderr, Env, Dir, Timeout and PTY the caller
+// needs, then Run/Start it. Env, Dir and Stdout fall back to the Shell's own
+// when not set; PTY is off unless PTY(true) is called, whatever Shell.PTY
+// says. The command still goes through the Shell's PATH resolution,
+// process-group setup and signal forwarding.
+type Command struct {
+	shell *Shell
+	name  string
+	args  []string
+
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	env     *env.Environment
+	dir     string
+	timeout time.Duration
+	pty     bool
+}
+
+// Command returns a Command builder for running name with arg in the
+// context of the shell.
+func (s *Shell) Command(name string, arg ...string) *Command {
+	return &Command{shell: s, name: name, args: arg}
+}
+
+// Stdin sets the reader the command's stdin is connected to
+func (c *Command) Stdin(r io.Reader) *Command {
+	c.stdin = r
+	return c
+}
+
+// Stdout sets the writer the command's stdout is written to, overriding the
+// shell's own Writer
+func (c *Command) Stdout(w io.Writer) *Command {
+	c.stdout = w
+	return c
+}
+
+// Stderr sets the writer the command's stderr is written to. By default
+// stderr is discarded, matching Shell.Run.
+func (c *Command) Stderr(w io.Writer) *Command {
+	c.stderr = w
+	return c
+}
+
+// Env overlays extra environment onto the shell's own environment for this
+// command only, with e taking precedence
+func (c *Command) Env(e *env.Environment) *Command {
+	c.env = e
+	return c
+}
+
+// Dir overrides the shell's working directory for this command only
+func (c *Command) Dir(dir string) *Command {
+	c.dir = dir
+	return c
+}
+
+// Timeout bounds how long the command is allowed to run before its process
+// group is sent SIGTERM, followed by SIGKILL after the shell's
+// TimeoutGracePeriod
+func (c *Command) Timeout(d time.Duration) *Command {
+	c.timeout = d
+	return c
+}
+
+// PTY sets whether the command is run attached to a pseudo-terminal
+func (c *Command) PTY(pty bool) *Command {
+	c.pty = pty
+	return c
+}
+
+// Run starts the command and blocks until it finishes
+func (c *Command) Run() error {
+	running, err := c.Start()
+	if err != nil {
+		return err
+	}
+	return running.Wait()
+}
+
+// Output runs the command and returns its captured stdout. It's an error to
+// call Output after Stdout has already been set.
+func (c *Command) Output() ([]byte, error) {
+	if c.stdout != nil {
+		return nil, errors.New("shell: Stdout already set")
+	}
+
+	var buf bytes.Buffer
+	c.stdout = &buf
+	err := c.Run()
+	return buf.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its captured stdout and
+// stderr, interleaved as they were written. It's an error to call
+// CombinedOutput after Stdout or Stderr has already been set.
+func (c *Command) CombinedOutput() ([]byte, error) {
+	if c.stdout != nil || c.stderr != nil {
+		return nil, errors.New("shell: Stdout or Stderr already set")
+	}
+
+	var buf bytes.Buffer
+	c.stdout = &buf
+	c.stderr = &buf
+	err := c.Run()
+	return buf.Bytes(), err
+}
+
+// build turns the Command into an exec.Cmd rooted in the shell's environment
+func (c *Command) build() (*exec.Cmd, error) {
+	cmd, err := c.shell.buildCommand(c.name, c.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dir != "" {
+		cmd.Dir = c.dir
+	}
+
+	if c.env != nil {
+		currentEnv := env.FromSlice(cmd.Env)
+		cmd.Env = currentEnv.Merge(c.env).ToSlice()
+	}
+
+	if c.stdin != nil {
+		cmd.Stdin = c.stdin
+	}
+
+	return cmd, nil
+}
+
+// Start starts the command without waiting for it to finish, returning a
+// RunningCommand that can be waited on, signalled or queried for its pid.
+// The command is echoed with Promptf before it starts. It shares
+// startCommand with executeCommand, so it gets the same PTY/signal handling,
+// debug dual-streaming and secret redaction as every other Run* method.
+func (c *Command) Start() (*RunningCommand, error) {
+	c.shell.Promptf("%s", process.FormatCommand(c.name, c.args))
+
+	cmd, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := c.stdout
+	if stdout == nil {
+		stdout = c.shell.Writer
+	}
+
+	running, err := c.shell.startCommand(cmd, stdout, c.stderr, c.pty)
+	if err != nil {
+		return nil, err
+	}
+
+	running.timeout = c.timeout
+	return running, nil
+}
+
+// RunningCommand is a command started by Command.Start (or executeCommand)
+// that hasn't yet been waited on.
+type RunningCommand struct {
+	shell       *Shell
+	cmd         *exec.Cmd
+	timeout     time.Duration
+	stopSignals func()
+	closers     []func()
+}
+
+// Pid returns the process id of the running command
+func (r *RunningCommand) Pid() int {
+	return r.cmd.Process.Pid
+}
+
+// Signal sends sig to the running command's process
+func (r *RunningCommand) Signal(sig os.Signal) error {
+	return signalProcess(r.cmd, sig)
+}
+
+// Wait blocks until the command finishes, killing its process group if the
+// command's Timeout (or the shell's own context deadline) is exceeded first
+func (r *RunningCommand) Wait() error {
+	defer r.stopSignals()
+	defer func() {
+		for _, closer := range r.closers {
+			closer()
+		}
+	}()
+
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- r.cmd.Wait() }()
+
+	return r.shell.waitForCommand(r.cmd, waitCh, r.timeout)
+}
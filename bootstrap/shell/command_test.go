@@ -0,0 +1,89 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/env"
+	"github.com/pkg/errors"
+)
+
+func TestCommandOutputCapturesStdout(t *testing.T) {
+	sh := newTestShell(t)
+
+	out, err := sh.Command("echo", "hello").Output()
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "hello" {
+		t.Errorf("Output() = %q, want %q", got, "hello")
+	}
+}
+
+func TestCommandCombinedOutputInterleavesStdoutAndStderr(t *testing.T) {
+	sh := newTestShell(t)
+
+	out, err := sh.Command("sh", "-c", "echo out; echo err 1>&2").CombinedOutput()
+	if err != nil {
+		t.Fatalf("CombinedOutput: %v", err)
+	}
+
+	got := string(out)
+	if !strings.Contains(got, "out") || !strings.Contains(got, "err") {
+		t.Errorf("CombinedOutput() = %q, want it to contain both \"out\" and \"err\"", got)
+	}
+}
+
+func TestCommandStdinIsPipedToProcess(t *testing.T) {
+	sh := newTestShell(t)
+
+	out, err := sh.Command("cat").Stdin(strings.NewReader("from stdin")).Output()
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if got := string(out); got != "from stdin" {
+		t.Errorf("Output() = %q, want %q", got, "from stdin")
+	}
+}
+
+func TestCommandEnvOverlaysShellEnv(t *testing.T) {
+	sh := newTestShell(t)
+	sh.Env.Set("COMMAND_TEST_VAR", "shell-value")
+
+	out, err := sh.Command("sh", "-c", "echo $COMMAND_TEST_VAR").
+		Env(env.FromSlice([]string{"COMMAND_TEST_VAR=overlay-value"})).
+		Output()
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "overlay-value" {
+		t.Errorf("Output() = %q, want %q", got, "overlay-value")
+	}
+}
+
+func TestCommandTimeoutTerminatesLongRunningCommand(t *testing.T) {
+	sh := newTestShell(t)
+	sh.TimeoutGracePeriod = 100 * time.Millisecond
+
+	start := time.Now()
+	err := sh.Command("sleep", "30").Timeout(50 * time.Millisecond).Run()
+	elapsed := time.Since(start)
+
+	if errors.Cause(err) != ErrTimeout {
+		t.Fatalf("Run() error = %v, want it to wrap ErrTimeout", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("Run took %s, expected it to return shortly after Timeout elapsed", elapsed)
+	}
+}
+
+func TestCommandOutputErrorsIfStdoutAlreadySet(t *testing.T) {
+	sh := newTestShell(t)
+
+	var buf strings.Builder
+	_, err := sh.Command("echo", "hi").Stdout(&buf).Output()
+	if err == nil {
+		t.Fatalf("Output: expected an error, got nil")
+	}
+}
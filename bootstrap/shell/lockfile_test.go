@@ -0,0 +1,80 @@
+package shell
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestShell(t *testing.T) *Shell {
+	t.Helper()
+
+	sh, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return sh
+}
+
+func TestLockFileAcquiresUncontendedLock(t *testing.T) {
+	sh := newTestShell(t)
+	path := filepath.Join(t.TempDir(), "lock")
+
+	lock, err := sh.LockFile(path, time.Second)
+	if err != nil {
+		t.Fatalf("LockFile: %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+}
+
+func TestLockFileTimesOutWhileHeld(t *testing.T) {
+	oldRetry := lockRetryDuration
+	lockRetryDuration = 10 * time.Millisecond
+	defer func() { lockRetryDuration = oldRetry }()
+
+	sh := newTestShell(t)
+	path := filepath.Join(t.TempDir(), "lock")
+
+	held, err := sh.LockFile(path, time.Second)
+	if err != nil {
+		t.Fatalf("LockFile (first): %v", err)
+	}
+	defer held.Unlock()
+
+	_, err = sh.LockFile(path, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("LockFile (second): expected a timeout error, got nil")
+	}
+}
+
+func TestLockFileRetriesUntilReleased(t *testing.T) {
+	oldRetry := lockRetryDuration
+	lockRetryDuration = 10 * time.Millisecond
+	defer func() { lockRetryDuration = oldRetry }()
+
+	sh := newTestShell(t)
+	path := filepath.Join(t.TempDir(), "lock")
+
+	held, err := sh.LockFile(path, time.Second)
+	if err != nil {
+		t.Fatalf("LockFile (first): %v", err)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		held.Unlock()
+		close(released)
+	}()
+
+	waiting, err := sh.LockFile(path, time.Second)
+	<-released
+	if err != nil {
+		t.Fatalf("LockFile (second): %v", err)
+	}
+	if err := waiting.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+}
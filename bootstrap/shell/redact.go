@@ -0,0 +1,153 @@
+package shell
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+const redactedPlaceholder = "***"
+
+// regexRedactorHoldBack is the holdback used whenever a regex redactor is
+// registered. A regex's source text length says nothing about how long the
+// strings it matches are (e.g. `AKIA[0-9A-Z]{16}` matches 20 chars from 16
+// bytes of pattern), so unlike literals we can't size the holdback exactly -
+// this is chosen generously enough to cover things like AWS keys and JWTs.
+const regexRedactorHoldBack = 4096
+
+// minAutoRedactedSecretLen is the shortest environment variable value that
+// seedDefaultRedactors will register as a literal redactor. Without this,
+// placeholder values commonly used in local/CI environments (e.g. a
+// single-character API_KEY) would cause every occurrence of that character
+// in command output to be redacted.
+const minAutoRedactedSecretLen = 6
+
+// defaultRedactedEnvSuffixes names the environment variable suffixes whose
+// values are automatically redacted from command output, on the assumption
+// that a variable named like one of these holds a secret.
+var defaultRedactedEnvSuffixes = []string{"_TOKEN", "_SECRET", "_PASSWORD", "_KEY"}
+
+// AddRedactor registers a regular expression whose matches are replaced with
+// "***" in command output, for things like AWS keys or JWTs that can't be
+// known as a literal value ahead of time.
+func (s *Shell) AddRedactor(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	s.redactors = append(s.redactors, re)
+	if regexRedactorHoldBack > s.redactorMaxLen {
+		s.redactorMaxLen = regexRedactorHoldBack
+	}
+	return nil
+}
+
+// AddRedactorLiteral registers a literal secret value to be replaced with
+// "***" in command output, e.g. one known at spawn time from the environment.
+func (s *Shell) AddRedactorLiteral(secret string) {
+	if secret == "" {
+		return
+	}
+
+	s.redactors = append(s.redactors, regexp.MustCompile(regexp.QuoteMeta(secret)))
+	if l := len(secret); l > s.redactorMaxLen {
+		s.redactorMaxLen = l
+	}
+}
+
+// seedDefaultRedactors registers a redactor for every environment variable
+// whose name looks like it holds a secret
+func (s *Shell) seedDefaultRedactors() {
+	for _, kv := range s.Env.ToSlice() {
+		name, value, ok := splitEnv(kv)
+		if !ok || len(value) < minAutoRedactedSecretLen {
+			continue
+		}
+
+		upperName := strings.ToUpper(name)
+		for _, suffix := range defaultRedactedEnvSuffixes {
+			if strings.HasSuffix(upperName, suffix) {
+				s.AddRedactorLiteral(value)
+				break
+			}
+		}
+	}
+}
+
+func splitEnv(kv string) (name, value string, ok bool) {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// redactingWriter wraps an io.Writer, replacing any redactor matches with
+// "***" before the bytes reach it. Matches that straddle two Write() calls
+// are still caught, by holding back up to holdBack bytes (the shell's
+// redactorMaxLen) until more data arrives (or Flush is called).
+type redactingWriter struct {
+	w         io.Writer
+	redactors []*regexp.Regexp
+	holdBack  int
+	buf       []byte
+}
+
+func (s *Shell) wrapRedactor(w io.Writer) (io.Writer, func() error) {
+	if len(s.redactors) == 0 {
+		return w, func() error { return nil }
+	}
+
+	rw := &redactingWriter{
+		w:         w,
+		redactors: s.redactors,
+		holdBack:  s.redactorMaxLen,
+	}
+	return rw, rw.Flush
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.buf = append(rw.buf, p...)
+
+	if len(rw.buf) <= rw.holdBack {
+		// Not enough buffered yet to be sure we've seen a whole secret
+		return len(p), nil
+	}
+
+	// Redact the *entire* buffered window, not just the piece we're about to
+	// flush - a match can start before the flush boundary and end after it,
+	// and slicing first would write that match out unredacted.
+	redacted := rw.redact(rw.buf)
+
+	flushLen := len(redacted) - rw.holdBack
+	if flushLen > 0 {
+		if _, err := rw.w.Write(redacted[:flushLen]); err != nil {
+			return 0, err
+		}
+	} else {
+		flushLen = 0
+	}
+
+	rw.buf = append([]byte(nil), redacted[flushLen:]...)
+	return len(p), nil
+}
+
+// Flush writes out any buffered, redacted bytes still being held back in
+// case they were the start of a split secret. Safe to call more than once.
+func (rw *redactingWriter) Flush() error {
+	if len(rw.buf) == 0 {
+		return nil
+	}
+
+	_, err := rw.w.Write(rw.redact(rw.buf))
+	rw.buf = nil
+	return err
+}
+
+func (rw *redactingWriter) redact(p []byte) []byte {
+	for _, re := range rw.redactors {
+		p = re.ReplaceAll(p, []byte(redactedPlaceholder))
+	}
+	return p
+}
@@ -0,0 +1,102 @@
+package shell
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+)
+
+// writeInChunks writes p to w split into pieces of at most chunkSize bytes,
+// to exercise writers that need to buffer across Write() calls.
+func writeInChunks(t *testing.T, w *redactingWriter, p []byte, chunkSize int) {
+	t.Helper()
+
+	for len(p) > 0 {
+		n := chunkSize
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		p = p[n:]
+	}
+}
+
+func TestRedactingWriterCatchesSecretSplitAcrossWrites(t *testing.T) {
+	const secret = "SECRETWORD"
+
+	var buf bytes.Buffer
+	rw := &redactingWriter{
+		w:         &buf,
+		redactors: []*regexp.Regexp{regexp.MustCompile(regexp.QuoteMeta(secret))},
+		holdBack:  len(secret),
+	}
+
+	// Write "hello SECRETWORD world" one byte at a time, so the secret is
+	// guaranteed to straddle several Write() calls.
+	writeInChunks(t, rw, []byte("hello "+secret+" world"), 1)
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	got := buf.String()
+	if strings.Contains(got, secret) {
+		t.Fatalf("secret leaked through unredacted: %q", got)
+	}
+	if !strings.Contains(got, redactedPlaceholder) {
+		t.Fatalf("expected %q to appear in output, got %q", redactedPlaceholder, got)
+	}
+}
+
+func TestRedactingWriterFlushIsIdempotent(t *testing.T) {
+	var buf bytes.Buffer
+	rw := &redactingWriter{
+		w:         &buf,
+		redactors: []*regexp.Regexp{regexp.MustCompile("secret")},
+		holdBack:  10,
+	}
+
+	if _, err := rw.Write([]byte("a secret value")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("second Flush: %v", err)
+	}
+
+	if strings.Count(buf.String(), redactedPlaceholder) != 1 {
+		t.Fatalf("expected exactly one redaction, got %q", buf.String())
+	}
+}
+
+func TestSeedDefaultRedactorsSkipsShortValues(t *testing.T) {
+	s := &Shell{Env: env.FromSlice([]string{
+		"SHORT_TOKEN=abc",
+		"LONG_TOKEN=abcdefgh",
+	})}
+
+	s.seedDefaultRedactors()
+
+	var buf bytes.Buffer
+	rw, flush := s.wrapRedactor(&buf)
+	if _, err := rw.Write([]byte("value is abc and abcdefgh")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	got := buf.String()
+	if !strings.Contains(got, "abc") {
+		t.Fatalf("short value should not have been redacted, got %q", got)
+	}
+	if strings.Contains(got, "abcdefgh") {
+		t.Fatalf("long value should have been redacted, got %q", got)
+	}
+}
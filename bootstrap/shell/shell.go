@@ -10,19 +10,28 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/buildkite/agent/env"
 	"github.com/buildkite/agent/process"
-	"github.com/nightlyone/lockfile"
 	"github.com/pkg/errors"
 )
 
 var (
 	lockRetryDuration = time.Second
+
+	// defaultTimeoutGracePeriod is how long we wait after sending SIGTERM to
+	// a timed-out command's process group before escalating to SIGKILL
+	defaultTimeoutGracePeriod = 10 * time.Second
+
+	// ErrTimeout is returned by the Run* family of methods when a command is
+	// killed because its timeout or deadline was exceeded
+	ErrTimeout = errors.New("Timeout exceeded")
 )
 
 // Shell represents a virtual shell, handles logging, executing commands and
@@ -49,6 +58,23 @@ type Shell struct {
 
 	// The context for the shell
 	ctx context.Context
+
+	// How long to wait after sending SIGTERM to a timed-out command before
+	// escalating to SIGKILL. Defaults to defaultTimeoutGracePeriod.
+	TimeoutGracePeriod time.Duration
+
+	// Interpreter overrides the interpreter RunScript uses to execute scripts.
+	// If empty, findInterpreter is used to work it out from the script itself.
+	Interpreter string
+
+	// redactors are applied to command output before it reaches Writer or the
+	// debug logger streamers, replacing matches with "***"
+	redactors []*regexp.Regexp
+
+	// redactorMaxLen sizes the redacting writer's holdback buffer: the length
+	// of the longest literal registered with AddRedactorLiteral, raised to
+	// regexRedactorHoldBack once any AddRedactor pattern is registered
+	redactorMaxLen int
 }
 
 // New returns a new Shell
@@ -58,13 +84,17 @@ func New() (*Shell, error) {
 		return nil, errors.Wrapf(err, "Failed to find current working directory")
 	}
 
-	return &Shell{
+	sh := &Shell{
 		Logger: StderrLogger,
 		Env:    env.FromSlice(os.Environ()),
 		Writer: os.Stdout,
 		wd:     wd,
 		ctx:    context.Background(),
-	}, nil
+	}
+
+	sh.seedDefaultRedactors()
+
+	return sh, nil
 }
 
 // New returns a new Shell with provided context.Context
@@ -122,49 +152,79 @@ func (s *Shell) AbsolutePath(executable string) (string, error) {
 	return filepath.Abs(absolutePath)
 }
 
-// LockFile is a pid-based lock for cross-process locking
+// LockFile is a cross-process lock held on an open file for as long as the
+// process holding it is alive. The kernel releases it the moment that
+// process exits, by any means, so there's nothing for callers to clean up.
 type LockFile interface {
+	// Fd returns the file descriptor the lock is held on, for callers that
+	// want to inherit it across exec.Cmd
+	Fd() uintptr
+
 	Unlock() error
 }
 
-// Create a cross-process file-based lock based on pid files
+// fileLock is a LockFile backed by flock(2) on Unix and LockFileEx on Windows
+type fileLock struct {
+	file *os.File
+}
+
+func (f *fileLock) Fd() uintptr {
+	return f.file.Fd()
+}
+
+func (f *fileLock) Unlock() error {
+	defer f.file.Close()
+	return unlockFile(f.file)
+}
+
+// LockFile creates a cross-process lock backed by an OS-level advisory lock
+// (flock on Unix, LockFileEx on Windows), retrying until either the lock is
+// acquired or timeout elapses.
 func (s *Shell) LockFile(path string, timeout time.Duration) (LockFile, error) {
 	absolutePathToLock, err := filepath.Abs(path)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to lock \"%s\" (%v)", path, err)
 	}
 
-	lock, err := lockfile.New(absolutePathToLock)
+	file, err := os.OpenFile(absolutePathToLock, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create lock \"%s\" (%s)", absolutePathToLock, err)
+		return nil, fmt.Errorf("Failed to open lock \"%s\" (%s)", absolutePathToLock, err)
 	}
 
 	ctx, cancel := context.WithTimeout(s.ctx, timeout)
 	defer cancel()
 
+	ticker := time.NewTicker(lockRetryDuration)
+	defer ticker.Stop()
+
 	for {
-		// Keep trying the lock until we get it
-		if err := lock.TryLock(); err != nil {
+		if err := tryLockFile(file); err == nil {
+			return &fileLock{file: file}, nil
+		} else {
 			s.Commentf("Could not acquire lock on \"%s\" (%s)", absolutePathToLock, err)
 			s.Commentf("Trying again in %s...", lockRetryDuration)
-			time.Sleep(lockRetryDuration)
-		} else {
-			break
 		}
 
 		select {
 		case <-ctx.Done():
+			file.Close()
 			return nil, ctx.Err()
-		default:
-			// No value ready, moving on
+		case <-ticker.C:
+			// Try again
 		}
 	}
-
-	return &lock, err
 }
 
 // Run runs a command, write stdout and stderr to the logger and return an error if it fails
 func (s *Shell) Run(command string, arg ...string) error {
+	return s.RunWithTimeout(0, command, arg...)
+}
+
+// RunWithTimeout is like Run, but kills the command's process group if it
+// hasn't finished within timeout (a timeout of 0 means no timeout, other than
+// whatever deadline the shell's own context carries). If the timeout fires,
+// the returned error wraps ErrTimeout.
+func (s *Shell) RunWithTimeout(timeout time.Duration, command string, arg ...string) error {
 	s.Promptf("%s", process.FormatCommand(command, arg))
 
 	cmd, err := s.buildCommand(command, arg...)
@@ -177,13 +237,19 @@ func (s *Shell) Run(command string, arg ...string) error {
 		Stdout: true,
 		Stderr: true,
 		PTY:    s.PTY,
-	})
+	}, timeout)
 }
 
 // RunAndCapture runs a command and captures the output for processing. Stdout is captured, but
 // stderr isn't. If the shell is in debug mode then the command will be eched and both stderr
 // and stdout will be written to the logger. A PTY is never used for RunAndCapture.
 func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
+	return s.RunAndCaptureWithTimeout(0, command, arg...)
+}
+
+// RunAndCaptureWithTimeout is like RunAndCapture, but kills the command's
+// process group if it hasn't finished within timeout.
+func (s *Shell) RunAndCaptureWithTimeout(timeout time.Duration, command string, arg ...string) (string, error) {
 	if s.Debug {
 		s.Promptf("%s", process.FormatCommand(command, arg))
 	}
@@ -199,7 +265,7 @@ func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
 		Stdout: true,
 		Stderr: false,
 		PTY:    false,
-	})
+	}, timeout)
 	if err != nil {
 		return "", err
 	}
@@ -211,35 +277,35 @@ func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
 // some extra checks to ensure it gets to the correct interpreter. It also supports
 // passing in extra environment just for that script
 func (s *Shell) RunScript(path string, extra *env.Environment) error {
-	// If you run a script on Linux that doesn't have the
-	// #!/bin/bash shebang at the top, it will fail to run with a
-	// "exec format error" error.
-
-	// You can solve it by adding the
-	// #!/bin/bash line to the top of the file, but that's
-	// annoying, and people generally forget it, so we'll make it
-	// easy on them and add it for them here.
-
-	// We also need to make sure the script we pass has quotes
-	// around it, otherwise `/bin/bash -c run script with space.sh` fails.
-
-	var command string
-	var args []string
+	return s.RunScriptWithTimeout(0, path, extra)
+}
 
-	if runtime.GOOS == "windows" {
-		command = path
-		args = []string{}
-	} else {
-		command = "/bin/bash"
-		args = []string{"-c", path}
+// RunScriptWithTimeout is like RunScript, but kills the script's process
+// group if it hasn't finished within timeout.
+func (s *Shell) RunScriptWithTimeout(timeout time.Duration, path string, extra *env.Environment) error {
+	// If you run a script on Linux that doesn't have a shebang at the top, it
+	// will fail to run with a "exec format error" error. We used to always
+	// prepend /bin/bash, but that breaks on systems where bash doesn't live
+	// there (Alpine, minimal containers, BSDs), so we work out the right
+	// interpreter to invoke instead.
+
+	// When the interpreter is run as `<shell> -c path` (an Interpreter
+	// override, or findInterpreter's fallback on Unix), the path is passed
+	// unquoted as the -c command string, so a path containing spaces is
+	// split into words by that shell.
+
+	command, args, err := s.resolveInterpreter(path)
+	if err != nil {
+		s.Errorf("Error resolving interpreter: %v", err)
+		return err
 	}
 
 	s.Promptf("%s", process.FormatCommand(command, args))
 
-	cmd, err := s.buildCommand(command, args...)
-	if err != nil {
-		s.Errorf("Error building command: %v", err)
-		return err
+	cmd, buildErr := s.buildCommand(command, args...)
+	if buildErr != nil {
+		s.Errorf("Error building command: %v", buildErr)
+		return buildErr
 	}
 
 	// Combine the two slices of env, let the latter overwrite the former
@@ -251,7 +317,22 @@ func (s *Shell) RunScript(path string, extra *env.Environment) error {
 		Stdout: true,
 		Stderr: true,
 		PTY:    s.PTY,
-	})
+	}, timeout)
+}
+
+// resolveInterpreter works out the command and arguments used to execute the
+// script at path. If s.Interpreter is set, it's used verbatim; otherwise
+// findInterpreter works it out from the script's shebang (Unix) or extension
+// (Windows).
+func (s *Shell) resolveInterpreter(path string) (string, []string, error) {
+	if s.Interpreter == "" {
+		return findInterpreter(path)
+	}
+
+	if runtime.GOOS == "windows" {
+		return s.Interpreter, []string{path}, nil
+	}
+	return s.Interpreter, []string{"-c", path}, nil
 }
 
 // buildCommand returns an exec.Cmd that runs in the context of the shell
@@ -266,6 +347,10 @@ func (s *Shell) buildCommand(name string, arg ...string) (*exec.Cmd, error) {
 	cmd.Env = s.Env.ToSlice()
 	cmd.Dir = s.wd
 
+	// Run the command in its own process group so that a timeout can clean up
+	// the whole tree of processes it spawns, not just the direct child
+	setNewProcessGroup(cmd)
+
 	return cmd, nil
 }
 
@@ -280,14 +365,34 @@ type executeFlags struct {
 	PTY bool
 }
 
-func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags) error {
+// executeCommand runs cmd to completion, used by the Run/RunAndCapture/
+// RunScript family. It's a thin wrapper around startCommand so that those
+// methods and the Command builder share identical signal-forwarding, PTY,
+// debug-streaming and redaction behavior.
+func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags, timeout time.Duration) error {
+	running, err := s.startCommand(cmd, w, nil, flags.PTY)
+	if err != nil {
+		return err
+	}
+
+	running.timeout = timeout
+	return running.Wait()
+}
+
+// startCommand starts cmd without waiting for it to finish, wiring up signal
+// forwarding, PTY or plain stdout/stderr capture, debug dual-streaming to the
+// logger, and secret redaction identically regardless of which of
+// executeCommand or Command.Start is driving it.
+func (s *Shell) startCommand(cmd *exec.Cmd, stdout, stderr io.Writer, pty bool) (*RunningCommand, error) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt,
 		syscall.SIGHUP,
 		syscall.SIGTERM,
 		syscall.SIGINT,
 		syscall.SIGQUIT)
-	defer signal.Stop(signals)
+
+	var stopOnce sync.Once
+	stopSignals := func() { stopOnce.Do(func() { signal.Stop(signals) }) }
 
 	go func() {
 		// forward signals to the process
@@ -298,61 +403,175 @@ func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags) e
 		}
 	}()
 
-	cmdStr := process.FormatCommand(cmd.Path, cmd.Args[1:])
+	var closers []func()
 
-	if flags.PTY {
-		pty, err := process.StartPTY(cmd)
+	if pty {
+		ptyF, err := process.StartPTY(cmd)
 		if err != nil {
-			return fmt.Errorf("Error starting PTY: %v", err)
+			stopSignals()
+			return nil, fmt.Errorf("Error starting PTY: %v", err)
 		}
 
-		// Copy the pty to our buffer. This will block until it EOF's
-		// or something breaks.
-		_, err = io.Copy(w, pty)
-		if e, ok := err.(*os.PathError); ok && e.Err == syscall.EIO {
-			// We can safely ignore this error, because it's just the PTY telling us
-			// that it closed successfully.
-			// See https://github.com/buildkite/agent/pull/34#issuecomment-46080419
-		}
+		redactingStdout, flush := s.wrapRedactor(stdout)
+
+		// Copy the pty to our buffer in the background. This will block until
+		// it EOF's or something breaks.
+		go func() {
+			defer flush()
+
+			_, err := io.Copy(redactingStdout, ptyF)
+			if e, ok := err.(*os.PathError); ok && e.Err == syscall.EIO {
+				// We can safely ignore this error, because it's just the PTY telling us
+				// that it closed successfully.
+				// See https://github.com/buildkite/agent/pull/34#issuecomment-46080419
+			}
+		}()
 	} else {
-		cmd.Stdout = w
-		cmd.Stderr = nil
-		cmd.Stdin = nil
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		// If stdout and stderr are the same writer (as Command.CombinedOutput
+		// sets up), keep cmd.Stdout and cmd.Stderr pointing at the exact same
+		// value the whole way through. os/exec special-cases that (the same
+		// check interfaceEqual below mirrors) to share a single pipe and
+		// copying goroutine between the two streams; wrapping each side in
+		// its own redactingWriter would defeat that and leave two goroutines
+		// writing the shared underlying writer at once.
+		combined := interfaceEqual(stdout, stderr)
 
 		if s.Debug {
 			stdOutStreamer := NewLoggerStreamer(s.Logger)
-			defer stdOutStreamer.Close()
-
-			stdErrStreamer := NewLoggerStreamer(s.Logger)
-			defer stdErrStreamer.Close()
+			closers = append(closers, func() { stdOutStreamer.Close() })
 
 			// write the stdout to the writer and stream both stdout and stderr to the logger
-			cmd.Stdout = io.MultiWriter(stdOutStreamer, w)
-			cmd.Stderr = stdErrStreamer
+			cmd.Stdout = io.MultiWriter(stdOutStreamer, stdout)
+
+			if combined {
+				cmd.Stderr = cmd.Stdout
+			} else {
+				stdErrStreamer := NewLoggerStreamer(s.Logger)
+				closers = append(closers, func() { stdErrStreamer.Close() })
+
+				if stderr != nil {
+					cmd.Stderr = io.MultiWriter(stdErrStreamer, stderr)
+				} else {
+					cmd.Stderr = stdErrStreamer
+				}
+			}
+		}
+
+		redactingStdout, flushStdout := s.wrapRedactor(cmd.Stdout)
+		cmd.Stdout = redactingStdout
+		closers = append(closers, func() { flushStdout() })
+
+		if combined {
+			cmd.Stderr = cmd.Stdout
+		} else if cmd.Stderr != nil {
+			redactingStderr, flushStderr := s.wrapRedactor(cmd.Stderr)
+			cmd.Stderr = redactingStderr
+			closers = append(closers, func() { flushStderr() })
 		}
 
 		if err := cmd.Start(); err != nil {
-			return errors.Wrapf(err, "Error starting `%s`", cmdStr)
+			stopSignals()
+			cmdStr := process.FormatCommand(cmd.Path, cmd.Args[1:])
+			return nil, errors.Wrapf(err, "Error starting `%s`", cmdStr)
+		}
+
+		if err := afterStart(cmd); err != nil {
+			s.Errorf("Error assigning process to job object: %v", err)
 		}
+		closers = append(closers, func() { releaseJob(cmd) })
 	}
 
-	if err := cmd.Wait(); err != nil {
-		if s.Debug {
-			s.Printf("Exited with error: %v", err)
+	return &RunningCommand{
+		shell:       s,
+		cmd:         cmd,
+		stopSignals: stopSignals,
+		closers:     closers,
+	}, nil
+}
+
+// interfaceEqual reports whether a and b hold the same value, the same way
+// os/exec's own (unexported) interfaceEqual does, so we can detect the same
+// "stdout and stderr are one writer" case it collapses onto a single pipe.
+// Comparing arbitrary interface values with == panics if the dynamic type
+// isn't comparable (e.g. a slice-backed io.Writer), so that's recovered into
+// a false rather than propagated.
+func interfaceEqual(a, b interface{}) (eq bool) {
+	defer func() {
+		if recover() != nil {
+			eq = false
 		}
+	}()
+	return a != nil && a == b
+}
 
-		return errors.Wrapf(err, "Error running `%s`", cmdStr)
+// waitForCommand waits on waitCh for cmd to finish, killing its process group
+// if timeout (or the shell's own context deadline, when timeout is 0) is
+// exceeded first: SIGTERM, then SIGKILL after TimeoutGracePeriod. Shared by
+// executeCommand and RunningCommand.Wait so both honor timeouts identically.
+func (s *Shell) waitForCommand(cmd *exec.Cmd, waitCh chan error, timeout time.Duration) error {
+	ctx := s.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	return nil
+	cmdStr := process.FormatCommand(cmd.Path, cmd.Args[1:])
+
+	select {
+	case err := <-waitCh:
+		if err != nil {
+			if s.Debug {
+				s.Printf("Exited with error: %v", err)
+			}
+
+			return errors.Wrapf(err, "Error running `%s`", cmdStr)
+		}
+
+		return nil
+
+	case <-ctx.Done():
+		s.Errorf("Command `%s` timed out, terminating", cmdStr)
+
+		gracePeriod := s.TimeoutGracePeriod
+		if gracePeriod <= 0 {
+			gracePeriod = defaultTimeoutGracePeriod
+		}
+
+		if err := terminateProcessGroup(cmd, syscall.SIGTERM); err != nil {
+			s.Errorf("Error sending SIGTERM to `%s`: %v", cmdStr, err)
+		}
+
+		select {
+		case <-waitCh:
+		case <-time.After(gracePeriod):
+			if err := terminateProcessGroup(cmd, syscall.SIGKILL); err != nil {
+				s.Errorf("Error sending SIGKILL to `%s`: %v", cmdStr, err)
+			}
+			<-waitCh
+		}
+
+		return errors.Wrapf(ErrTimeout, "Error running `%s`", cmdStr)
+	}
 }
 
+// TimeoutExitCode is the exit code returned by GetExitCode for commands
+// killed because their timeout or deadline was exceeded
+const TimeoutExitCode = -1
+
 // GetExitCode extracts an exit code from an error where the platform supports it,
 // otherwise returns 0 for no error and 1 for an error
+// An error whose cause is ErrTimeout gives TimeoutExitCode instead.
 func GetExitCode(err error) int {
 	if err == nil {
 		return 0
 	}
+	if errors.Cause(err) == ErrTimeout {
+		return TimeoutExitCode
+	}
 	switch cause := errors.Cause(err).(type) {
 	case *exec.ExitError:
 		// The program has exited with an exit code != 0
@@ -0,0 +1,113 @@
+// +build !windows
+
+package shell
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var errTimedOutWaitingForFile = errors.New("timed out waiting for file")
+
+// processAlive reports whether pid still names a running process, using a
+// zero signal, which checks for the process without delivering anything.
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func TestRunWithTimeoutEscalatesToSigkillAndKillsProcessGroup(t *testing.T) {
+	sh := newTestShell(t)
+	sh.TimeoutGracePeriod = 100 * time.Millisecond
+
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "grandchild.pid")
+
+	// A script that ignores SIGTERM and forks a grandchild that does the
+	// same, so neither dies until the process group is SIGKILLed.
+	script := filepath.Join(dir, "ignore-term.sh")
+	body := "#!/bin/sh\n" +
+		"trap '' TERM\n" +
+		"sh -c 'trap \"\" TERM; sleep 30' &\n" +
+		"echo $! > " + pidFile + "\n" +
+		"while true; do sleep 0.1; done\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	start := time.Now()
+	err := sh.RunWithTimeout(50*time.Millisecond, script)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("RunWithTimeout: expected a timeout error, got nil")
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("RunWithTimeout took %s, expected it to return shortly after the grace period", elapsed)
+	}
+
+	pidBytes, err := waitForFile(pidFile, time.Second)
+	if err != nil {
+		t.Fatalf("grandchild never recorded its pid: %v", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		t.Fatalf("parsing grandchild pid %q: %v", pidBytes, err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("grandchild process %d is still alive after process-group kill", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRunKilledByShellContextDeadlineWithNoExplicitTimeout(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(50*time.Millisecond))
+	defer cancel()
+
+	sh, err := NewWithContext(ctx)
+	if err != nil {
+		t.Fatalf("NewWithContext: %v", err)
+	}
+	sh.TimeoutGracePeriod = 100 * time.Millisecond
+
+	start := time.Now()
+	// RunWithTimeout(0, ...) - and so Run, which is just RunWithTimeout(0, ...) - has no
+	// timeout of its own, so it's only waitForCommand falling through to the
+	// shell's own ctx that should get this killed.
+	err = sh.Run("sleep", "30")
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("Run: expected a timeout error from the shell's own context deadline, got nil")
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("Run took %s, expected it to return shortly after the context deadline", elapsed)
+	}
+	if code := GetExitCode(err); code != TimeoutExitCode {
+		t.Errorf("GetExitCode(err) = %d, want %d", code, TimeoutExitCode)
+	}
+}
+
+func waitForFile(path string, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if b, err := os.ReadFile(path); err == nil && len(b) > 0 {
+			return b, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errTimedOutWaitingForFile
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
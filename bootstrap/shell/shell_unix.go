@@ -0,0 +1,111 @@
+// +build !windows
+
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// setNewProcessGroup configures cmd to run in its own process group, so that
+// signals (and our own timeout termination) can be sent to the whole tree of
+// processes it spawns rather than just the direct child.
+func setNewProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// afterStart is a no-op on Unix, where setNewProcessGroup's Setpgid is
+// already enough to let terminateProcessGroup reach the whole process tree.
+// Windows needs an extra step here to assign the process to a job object.
+func afterStart(cmd *exec.Cmd) error {
+	return nil
+}
+
+// releaseJob is a no-op on Unix; see the Windows implementation.
+func releaseJob(cmd *exec.Cmd) {}
+
+// terminateProcessGroup sends sig to the process group headed by cmd, rather
+// than just the process itself, so that orphaned children get cleaned up too.
+func terminateProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	unixSig, ok := sig.(syscall.Signal)
+	if !ok {
+		unixSig = syscall.SIGKILL
+	}
+
+	// A negative pid signals the whole process group rather than a single pid
+	err := syscall.Kill(-cmd.Process.Pid, unixSig)
+	if err == syscall.ESRCH {
+		// The group is already gone, nothing left to do
+		return nil
+	}
+	return err
+}
+
+// tryLockFile attempts to take an exclusive, non-blocking flock on f,
+// returning an error immediately if it's already held elsewhere.
+func tryLockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// unlockFile releases a lock taken with tryLockFile
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// findInterpreter works out the interpreter to run the script at path with.
+// It reads the script's shebang line (the first two bytes, `#!`) and uses it
+// verbatim, falling back to $SHELL, then bash, then sh if there isn't one.
+func findInterpreter(path string) (string, []string, error) {
+	if shebang, args, ok := readShebang(path); ok {
+		return shebang, args, nil
+	}
+
+	candidates := []string{os.Getenv("SHELL"), "bash", "sh"}
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if resolved, err := exec.LookPath(candidate); err == nil {
+			return resolved, []string{"-c", path}, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("Could not find a shell to run \"%s\" with", path)
+}
+
+// readShebang returns the interpreter and arguments named by the script's
+// shebang line, if it has one.
+func readShebang(path string) (string, []string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, false
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	prefix, err := r.Peek(2)
+	if err != nil || string(prefix) != "#!" {
+		return "", nil, false
+	}
+	r.Discard(2)
+
+	line, _ := r.ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+
+	return fields[0], append(fields[1:], path), true
+}
@@ -0,0 +1,85 @@
+// +build !windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadShebangUsesShebangLineVerbatim(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(path, []byte("#!/usr/bin/env bash -x\necho hi\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	interpreter, args, ok := readShebang(path)
+	if !ok {
+		t.Fatalf("readShebang(%q) found no shebang", path)
+	}
+	if interpreter != "/usr/bin/env" {
+		t.Errorf("interpreter = %q, want %q", interpreter, "/usr/bin/env")
+	}
+
+	want := []string{"bash", "-x", path}
+	if len(args) != len(want) {
+		t.Fatalf("args = %v, want %v", args, want)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("args[%d] = %q, want %q", i, args[i], want[i])
+		}
+	}
+}
+
+func TestReadShebangMissingShebangReturnsFalse(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(path, []byte("echo hi\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, _, ok := readShebang(path); ok {
+		t.Fatalf("readShebang(%q) unexpectedly found a shebang", path)
+	}
+}
+
+func TestFindInterpreterFallsBackToShellEnvVar(t *testing.T) {
+	sh, err := exec.LookPath("bash")
+	if err != nil {
+		sh, err = exec.LookPath("sh")
+	}
+	if err != nil {
+		t.Skip("no shell available to resolve SHELL against")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "noshebang.sh")
+	if err := os.WriteFile(path, []byte("echo hi\n"), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	oldShell, hadShell := os.LookupEnv("SHELL")
+	os.Setenv("SHELL", sh)
+	defer func() {
+		if hadShell {
+			os.Setenv("SHELL", oldShell)
+		} else {
+			os.Unsetenv("SHELL")
+		}
+	}()
+
+	interpreter, args, err := findInterpreter(path)
+	if err != nil {
+		t.Fatalf("findInterpreter: %v", err)
+	}
+	if interpreter != sh {
+		t.Errorf("interpreter = %q, want %q", interpreter, sh)
+	}
+	if len(args) != 2 || args[0] != "-c" || args[1] != path {
+		t.Errorf("args = %v, want [-c %s]", args, path)
+	}
+}
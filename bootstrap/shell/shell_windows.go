@@ -0,0 +1,116 @@
+// +build windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// jobHandles tracks the job object each running cmd was assigned to by
+// afterStart, so terminateProcessGroup and releaseJob can find it again.
+// exec.Cmd has no room for extra fields, so we key off the pointer instead.
+var jobHandles sync.Map // map[*exec.Cmd]windows.Handle
+
+// setNewProcessGroup puts cmd in its own process group. The job object that
+// actually lets us terminate its whole process tree is created once the
+// process exists, by afterStart - a job can't be assigned to a process until
+// the process has a handle to assign it to.
+func setNewProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_NEW_PROCESS_GROUP
+}
+
+// afterStart creates a job object and assigns cmd's freshly-started process
+// to it, so that terminateProcessGroup can later kill the whole tree of
+// processes it spawns rather than just the direct child.
+func afterStart(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	procHandle, err := windows.OpenProcess(windows.PROCESS_ALL_ACCESS, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+	defer windows.CloseHandle(procHandle)
+
+	if err := windows.AssignProcessToJobObject(job, procHandle); err != nil {
+		windows.CloseHandle(job)
+		return err
+	}
+
+	jobHandles.Store(cmd, job)
+	return nil
+}
+
+// releaseJob closes the job object handle created by afterStart, once cmd
+// has finished and it's no longer needed
+func releaseJob(cmd *exec.Cmd) {
+	if v, ok := jobHandles.LoadAndDelete(cmd); ok {
+		windows.CloseHandle(v.(windows.Handle))
+	}
+}
+
+// terminateProcessGroup terminates the job object that cmd's process was
+// assigned to by afterStart, killing the whole tree rather than just the
+// direct child. A graceful SIGTERM isn't a meaningful concept on Windows, so
+// any signal results in an immediate TerminateJobObject.
+func terminateProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	if v, ok := jobHandles.Load(cmd); ok {
+		return windows.TerminateJobObject(v.(windows.Handle), 1)
+	}
+
+	// No job object - e.g. afterStart failed - so fall back to killing just
+	// the direct process
+	return cmd.Process.Kill()
+}
+
+// tryLockFile attempts to take an exclusive, non-blocking lock on f via
+// LockFileEx, returning an error immediately if it's already held elsewhere.
+func tryLockFile(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0,
+		&overlapped,
+	)
+}
+
+// unlockFile releases a lock taken with tryLockFile
+func unlockFile(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &overlapped)
+}
+
+// findInterpreter works out the interpreter to run the script at path with,
+// based on its file extension.
+func findInterpreter(path string) (string, []string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ps1":
+		return "powershell", []string{"-File", path}, nil
+	case ".cmd", ".bat":
+		return "cmd", []string{"/C", path}, nil
+	default:
+		return path, []string{}, nil
+	}
+}
@@ -0,0 +1,216 @@
+package shell
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Workspace is a per-job sandbox directory tree, modelled on the allocdir
+// layout used by schedulers like Nomad: a `local/` dir for job-owned files, a
+// `shared/` dir, and a `tmp/` dir for scratch space, all three under Root.
+// NewWorkspace uses the root it is given as-is, and Cleanup removes all three
+// dirs together with Root.
+type Workspace struct {
+	// Root is the workspace's root directory
+	Root string
+
+	// Local is where job-owned files live, e.g. a checkout or build output
+	Local string
+
+	// Shared is a second directory under Root, alongside Local; Chroot does
+	// not point anything at it
+	Shared string
+
+	// Tmp is scratch space, wired up as TMPDIR when the workspace is chrooted
+	Tmp string
+}
+
+// NewWorkspace creates a new Workspace rooted at root, creating its
+// local/shared/tmp subdirectories.
+func NewWorkspace(root string) (*Workspace, error) {
+	w := &Workspace{
+		Root:   root,
+		Local:  filepath.Join(root, "local"),
+		Shared: filepath.Join(root, "shared"),
+		Tmp:    filepath.Join(root, "tmp"),
+	}
+
+	for _, dir := range []string{w.Local, w.Shared, w.Tmp} {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return nil, fmt.Errorf("Failed to create workspace directory \"%s\" (%v)", dir, err)
+		}
+	}
+
+	return w, nil
+}
+
+// Embed places host files and directories into the workspace's local dir.
+// The map is keyed by host source path, with the value being the destination
+// path relative to Local. Files are hardlinked when the workspace lives on
+// the same filesystem as the source, falling back to a copy otherwise.
+func (w *Workspace) Embed(paths map[string]string) error {
+	for src, destRel := range paths {
+		dest := filepath.Join(w.Local, destRel)
+
+		info, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("Failed to embed \"%s\" (%v)", src, err)
+		}
+
+		if info.IsDir() {
+			if err := embedDir(src, dest); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := embedFile(src, dest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func embedDir(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(destPath, info.Mode().Perm())
+		}
+
+		return embedFile(path, destPath)
+	})
+}
+
+func embedFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0770); err != nil {
+		return err
+	}
+
+	// Try a hardlink first - cheap, and keeps the sandbox in sync with the
+	// source until either side is modified
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	return copyFile(src, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// Chroot repoints the shell's working directory and workspace-related
+// environment variables into the workspace, so that anything the shell
+// subsequently runs sees the sandbox rather than the agent's own filesystem
+// layout. TMPDIR, TEMP and TMP (the latter two being the Windows equivalents
+// of TMPDIR) all point at Tmp, and HOME points at Local.
+func (w *Workspace) Chroot(sh *Shell) error {
+	if err := sh.Chdir(w.Local); err != nil {
+		return err
+	}
+
+	sh.Env.Set("TMPDIR", w.Tmp)
+	sh.Env.Set("TEMP", w.Tmp)
+	sh.Env.Set("TMP", w.Tmp)
+	sh.Env.Set("HOME", w.Local)
+
+	return nil
+}
+
+// Cleanup removes the workspace's directory tree
+func (w *Workspace) Cleanup() error {
+	return os.RemoveAll(w.Root)
+}
+
+// Snapshot tars up the workspace's contents and returns the archive
+func (w *Workspace) Snapshot() (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	err := filepath.Walk(w.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(w.Root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() || linkTarget != "" {
+			return nil
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write(contents)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
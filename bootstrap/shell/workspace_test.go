@@ -0,0 +1,145 @@
+package shell
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceEmbedHardlinksOnSameFilesystem(t *testing.T) {
+	root := t.TempDir()
+	w, err := NewWorkspace(filepath.Join(root, "workspace"))
+	if err != nil {
+		t.Fatalf("NewWorkspace: %v", err)
+	}
+
+	src := filepath.Join(root, "source.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := w.Embed(map[string]string{src: "source.txt"}); err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	dest := filepath.Join(w.Local, "source.txt")
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("Stat(src): %v", err)
+	}
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("Stat(dest): %v", err)
+	}
+	if !os.SameFile(srcInfo, destInfo) {
+		t.Errorf("Embed() copied %q instead of hardlinking it to %q", dest, src)
+	}
+}
+
+func TestWorkspaceEmbedFallsBackToCopyWhenLinkFails(t *testing.T) {
+	root := t.TempDir()
+	w, err := NewWorkspace(filepath.Join(root, "workspace"))
+	if err != nil {
+		t.Fatalf("NewWorkspace: %v", err)
+	}
+
+	src := filepath.Join(root, "source.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Pre-create the destination so os.Link fails (file exists), forcing
+	// Embed down the copy path the same way a cross-filesystem EXDEV would.
+	dest := filepath.Join(w.Local, "source.txt")
+	if err := os.WriteFile(dest, []byte("stale"), 0644); err != nil {
+		t.Fatalf("WriteFile(dest): %v", err)
+	}
+
+	if err := w.Embed(map[string]string{src: "source.txt"}); err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("Stat(src): %v", err)
+	}
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("Stat(dest): %v", err)
+	}
+	if os.SameFile(srcInfo, destInfo) {
+		t.Fatalf("Embed() hardlinked %q instead of copying it", dest)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("ReadFile(dest): %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("dest contents = %q, want %q", got, "hello")
+	}
+}
+
+func TestWorkspaceCleanupRemovesRoot(t *testing.T) {
+	root := t.TempDir()
+	w, err := NewWorkspace(filepath.Join(root, "workspace"))
+	if err != nil {
+		t.Fatalf("NewWorkspace: %v", err)
+	}
+
+	if err := w.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if _, err := os.Stat(w.Root); !os.IsNotExist(err) {
+		t.Errorf("Stat(w.Root) after Cleanup = %v, want IsNotExist", err)
+	}
+}
+
+func TestWorkspaceSnapshotRoundTripsSymlink(t *testing.T) {
+	root := t.TempDir()
+	w, err := NewWorkspace(filepath.Join(root, "workspace"))
+	if err != nil {
+		t.Fatalf("NewWorkspace: %v", err)
+	}
+
+	target := filepath.Join(w.Local, "real.txt")
+	if err := os.WriteFile(target, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	link := filepath.Join(w.Local, "link.txt")
+	if err := os.Symlink("real.txt", link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	buf, err := w.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	var found bool
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if header.Name != filepath.Join("local", "link.txt") {
+			continue
+		}
+
+		found = true
+		if header.Typeflag != tar.TypeSymlink {
+			t.Errorf("Typeflag = %v, want TypeSymlink", header.Typeflag)
+		}
+		if header.Linkname != "real.txt" {
+			t.Errorf("Linkname = %q, want %q", header.Linkname, "real.txt")
+		}
+	}
+
+	if !found {
+		t.Fatalf("Snapshot() archive has no entry for %q", filepath.Join("local", "link.txt"))
+	}
+}